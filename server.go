@@ -1,14 +1,34 @@
 package mongonet
 
+import "bytes"
+import "compress/zlib"
+import "context"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import crand "crypto/rand"
+import "crypto/sha256"
 import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/binary"
 import "fmt"
 import "io"
+import "io/ioutil"
+import "math/big"
 import "net"
+import "os"
+import "os/signal"
 import "strings"
+import "sync"
+import "sync/atomic"
+import "syscall"
 import "time"
 
 import "gopkg.in/mgo.v2/bson"
 
+import "github.com/coreos/go-systemd/daemon"
+import "github.com/golang/snappy"
+import "github.com/klauspost/compress/zstd"
 import "github.com/mongodb/slogger/v2/slogger"
 
 type ServerConfig struct {
@@ -19,8 +39,54 @@ type ServerConfig struct {
 	SSLKeys       []SSLPair
 	MinTlsVersion uint16 // see tls.Version* constants
 
+	// ClientAuth controls whether/how client certificates are requested and
+	// verified during the TLS handshake. Defaults to tls.NoClientCert.
+	ClientAuth tls.ClientAuthType
+	// ClientCAFile, if set, is a PEM file of CAs used to verify client
+	// certificates. Ignored if ClientCAs is set.
+	ClientCAFile string
+	// ClientCAs is the pool of CAs used to verify client certificates. Takes
+	// precedence over ClientCAFile.
+	ClientCAs *x509.CertPool
+	// VerifyPeerCertificate, if set, is passed straight through to
+	// tls.Config.VerifyPeerCertificate for custom client cert validation.
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+	// WatchCertFiles, if set, polls the mtime of every SSLPair's cert/key
+	// file and calls ReloadTLS when one changes, so certs rotated on disk by
+	// something like Vault or cert-manager take effect without a restart.
+	WatchCertFiles bool
+
+	// MaxConcurrentConnections caps the number of sessions served at once.
+	// 0 means unlimited. What happens once the cap is reached is governed
+	// by OnLimit.
+	MaxConcurrentConnections int
+	// MaxConnectionsPerRemoteIP caps the number of concurrent sessions
+	// accepted from a single remote IP. 0 means unlimited.
+	MaxConnectionsPerRemoteIP int
+	// OnLimit controls what happens to a new connection once
+	// MaxConcurrentConnections is reached. Defaults to LimitPolicyReject.
+	OnLimit LimitPolicy
+
+	// AutoCert, when set, makes Server.Run synthesize a self-signed TLS
+	// certificate at startup instead of loading SSLKeys, so tests and
+	// example programs using mongonet don't need cert fixtures checked in.
+	// Mutually exclusive with SSLKeys.
+	AutoCert bool
+	// AutoCertTTL is how long the generated certificate is valid for.
+	// Defaults to 24 hours.
+	AutoCertTTL time.Duration
+	// AutoCertHosts are the DNS names put on the generated certificate.
+	// Defaults to BindHost and "localhost".
+	AutoCertHosts []string
+
 	TCPKeepAlivePeriod time.Duration // set to 0 for no keep alives
 
+	// NotifyReady, when set, calls sd_notify(READY=1) once the listener is
+	// bound and sd_notify(STOPPING=1) when Shutdown begins, so mongonet-based
+	// proxies can run as systemd Type=notify units.
+	NotifyReady bool
+
 	LogLevel  slogger.Level
 	Appenders []slogger.Appender
 }
@@ -35,6 +101,220 @@ type Session struct {
 	logger *slogger.Logger
 
 	SSLServerName string
+
+	// Populated after a successful TLS handshake when the client presented a
+	// certificate, letting a ServerWorkerFactory authorize based on identity
+	// without re-doing the type assertion on conn.
+	PeerCertificates []*x509.Certificate
+	PeerCommonName   string
+	PeerSANs         []string
+
+	// compressor is the wire-protocol compressor negotiated with the client
+	// (e.g. via NegotiateCompression, once a ServerWorkerFactory has parsed
+	// the "compression" array off the client's hello/isMaster), or nil if
+	// none was negotiated.
+	compressor   Compressor
+	compressorId uint8
+
+	// lastRequestOriginalOpcode is set via NoteRequestOpcode before
+	// RespondToCommand/RespondWithError are called for a request that arrived
+	// as OP_COMPRESSED, so they know what opcode it contained. It is only
+	// consulted when the clientMessage passed to them is itself OP_COMPRESSED,
+	// so a later uncompressed request can never pick up a stale value.
+	lastRequestOriginalOpcode int32
+}
+
+// --------
+
+// Compressor implements one of the wire-protocol compression algorithms
+// exchanged inside OP_COMPRESSED messages.
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCompressor) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+type zlibCompressor struct{}
+
+func (zlibCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (zlibCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) Compress(data []byte) ([]byte, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	return enc.EncodeAll(data, nil), nil
+}
+
+func (zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	return dec.DecodeAll(data, nil)
+}
+
+// Wire-protocol compressor ids, per the OP_COMPRESSED spec.
+const (
+	compressorIdNoop   uint8 = 0
+	compressorIdSnappy uint8 = 1
+	compressorIdZlib   uint8 = 2
+	compressorIdZstd   uint8 = 3
+)
+
+var compressorsByName = map[string]Compressor{
+	"snappy": snappyCompressor{},
+	"zlib":   zlibCompressor{},
+	"zstd":   zstdCompressor{},
+}
+
+var compressorIdsByName = map[string]uint8{
+	"snappy": compressorIdSnappy,
+	"zlib":   compressorIdZlib,
+	"zstd":   compressorIdZstd,
+}
+
+var compressorsById = map[uint8]Compressor{
+	compressorIdSnappy: snappyCompressor{},
+	compressorIdZlib:   zlibCompressor{},
+	compressorIdZstd:   zstdCompressor{},
+}
+
+// NegotiateCompression selects the first mutually-supported compressor from
+// a client's advertised list -- e.g. the "compression" array of its
+// hello/isMaster -- preferring snappy, then zstd, then zlib, the order most
+// drivers advertise them in. Call it once a ServerWorkerFactory has parsed
+// that handshake; RespondToCommand/RespondWithError use the result to reply
+// with OP_COMPRESSED whenever the request being answered was compressed.
+func (s *Session) NegotiateCompression(clientCompressors []string) {
+	for _, name := range []string{"snappy", "zstd", "zlib"} {
+		for _, advertised := range clientCompressors {
+			if advertised == name {
+				s.compressor = compressorsByName[name]
+				s.compressorId = compressorIdsByName[name]
+				return
+			}
+		}
+	}
+}
+
+// NoteRequestOpcode records the opcode a message contained before
+// decompression, for a request that arrived as OP_COMPRESSED.
+// RespondToCommand/RespondWithError consult this -- only when the
+// clientMessage they're given is itself OP_COMPRESSED -- to pick the reply
+// shape and compress the reply to match.
+func (s *Session) NoteRequestOpcode(originalOpcode int32) {
+	s.lastRequestOriginalOpcode = originalOpcode
+}
+
+// DecompressIncoming decompresses the body of an incoming OP_COMPRESSED
+// message, given the compressorId and originalOpcode off its header and the
+// compressed payload that follows. A ServerWorker's DoLoopTemp -- which owns
+// reading OP_COMPRESSED frames off the wire -- calls this before dispatching
+// the returned bytes to command handling; it also records the compressor and
+// original opcode on the session (equivalent to calling NoteRequestOpcode),
+// so the matching RespondToCommand/RespondWithError call replies compressed.
+func (s *Session) DecompressIncoming(originalOpcode int32, compressorId uint8, compressed []byte) ([]byte, error) {
+	compressor, ok := compressorsById[compressorId]
+	if !ok {
+		return nil, fmt.Errorf("unknown compressor id %d", compressorId)
+	}
+
+	body, err := compressor.Decompress(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing request: %s", err)
+	}
+
+	s.compressor = compressor
+	s.compressorId = compressorId
+	s.NoteRequestOpcode(originalOpcode)
+
+	return body, nil
+}
+
+// sendPossiblyCompressed sends rm as-is, unless wasCompressed is true (the
+// request currently being answered arrived as OP_COMPRESSED) and a
+// compressor was negotiated for this session, in which case it wraps rm in
+// an OP_COMPRESSED frame: the standard message header followed by
+// {originalOpcode, uncompressedSize, compressorId} and the compressed
+// payload.
+func (s *Session) sendPossiblyCompressed(rm Message, wasCompressed bool) error {
+	if s.compressor == nil || !wasCompressed {
+		return SendMessage(rm, s.conn)
+	}
+
+	var raw bytes.Buffer
+	if err := SendMessage(rm, &raw); err != nil {
+		return err
+	}
+
+	const stdHeaderSize = 16 // messageLength, requestID, responseTo, opCode
+	header := raw.Bytes()[:stdHeaderSize]
+	body := raw.Bytes()[stdHeaderSize:]
+
+	compressedBody, err := s.compressor.Compress(body)
+	if err != nil {
+		return fmt.Errorf("error compressing reply: %s", err)
+	}
+
+	requestID := int32(binary.LittleEndian.Uint32(header[4:8]))
+	responseTo := int32(binary.LittleEndian.Uint32(header[8:12]))
+	originalOpcode := int32(binary.LittleEndian.Uint32(header[12:16]))
+
+	out := &bytes.Buffer{}
+	for _, field := range []int32{
+		int32(stdHeaderSize + 9 + len(compressedBody)),
+		requestID,
+		responseTo,
+		int32(OP_COMPRESSED),
+		originalOpcode,
+		int32(len(body)),
+	} {
+		if err := binary.Write(out, binary.LittleEndian, field); err != nil {
+			return fmt.Errorf("error building OP_COMPRESSED reply: %s", err)
+		}
+	}
+	if err := out.WriteByte(s.compressorId); err != nil {
+		return fmt.Errorf("error building OP_COMPRESSED reply: %s", err)
+	}
+	if _, err := out.Write(compressedBody); err != nil {
+		return fmt.Errorf("error building OP_COMPRESSED reply: %s", err)
+	}
+
+	_, err = s.conn.Write(out.Bytes())
+	return err
 }
 
 // --------
@@ -49,13 +329,66 @@ type ServerWorkerFactory interface {
 
 // --------
 
+// LimitPolicy controls what a Server does with a new connection once
+// MaxConcurrentConnections has been reached.
+type LimitPolicy int
+
+const (
+	// LimitPolicyReject immediately closes connections beyond the limit.
+	LimitPolicyReject LimitPolicy = iota
+	// LimitPolicyBlock stops accepting new connections until room frees up.
+	LimitPolicyBlock
+)
+
+// ServerStats is a snapshot of a Server's connection counters, suitable for
+// wiring into an operator's metrics endpoint.
+type ServerStats struct {
+	Active   int64
+	Accepted int64
+	Rejected int64
+	PerIP    map[string]int
+}
+
+// --------
+
+// certStore holds the server's current TLS certificates behind an
+// atomic.Value so that in-flight handshakes always see a consistent set and
+// ReloadTLS can swap them in without a lock.
+type certStore struct {
+	current atomic.Value // []tls.Certificate
+}
+
+func (cs *certStore) Load() []tls.Certificate {
+	certs, _ := cs.current.Load().([]tls.Certificate)
+	return certs
+}
+
+func (cs *certStore) Store(certs []tls.Certificate) {
+	cs.current.Store(certs)
+}
+
+// --------
+
 type Server struct {
 	config        ServerConfig
 	logger        *slogger.Logger
 	workerFactory ServerWorkerFactory
 	killChan      chan struct{}
+	killChanOnce  sync.Once
 	initChan      chan error
 	doneChan      chan struct{}
+	sessions      sync.Map // *Session -> struct{}, tracks sessions currently being served
+	certStore     *certStore
+
+	connSem chan struct{} // sized to MaxConcurrentConnections, nil if unlimited
+
+	perIPMu sync.Mutex
+	perIP   map[string]int
+
+	activeCount   int64
+	acceptedCount int64
+	rejectedCount int64
+
 	net.Addr
 }
 
@@ -77,6 +410,9 @@ func (s *Session) Run(conn net.Conn) {
 
 	s.conn = conn
 
+	s.server.sessions.Store(s, struct{}{})
+	defer s.server.sessions.Delete(s)
+
 	switch c := conn.(type) {
 	case *tls.Conn:
 		// we do this here so that we can get the SNI server name
@@ -85,7 +421,18 @@ func (s *Session) Run(conn net.Conn) {
 			s.logger.Logf(slogger.WARN, "error doing tls handshake %s", err)
 			return
 		}
-		s.SSLServerName = strings.TrimSuffix(c.ConnectionState().ServerName, ".")
+		state := c.ConnectionState()
+		s.SSLServerName = strings.TrimSuffix(state.ServerName, ".")
+		if len(state.PeerCertificates) > 0 {
+			s.PeerCertificates = state.PeerCertificates
+			leaf := state.PeerCertificates[0]
+			s.PeerCommonName = leaf.Subject.CommonName
+			s.PeerSANs = append(s.PeerSANs, leaf.DNSNames...)
+			s.PeerSANs = append(s.PeerSANs, leaf.EmailAddresses...)
+			for _, ip := range leaf.IPAddresses {
+				s.PeerSANs = append(s.PeerSANs, ip.String())
+			}
+		}
 	}
 
 	s.logger.Logf(slogger.INFO, "new connection SSLServerName [%s]", s.SSLServerName)
@@ -133,7 +480,13 @@ func (s *Session) RespondToCommandMakeBSON(clientMessage Message, args ...interf
 }
 
 func (s *Session) RespondToCommand(clientMessage Message, doc SimpleBSON) error {
-	switch clientMessage.Header().OpCode {
+	opCode := clientMessage.Header().OpCode
+	wasCompressed := opCode == OP_COMPRESSED
+	if wasCompressed {
+		opCode = s.lastRequestOriginalOpcode
+	}
+
+	switch opCode {
 
 	case OP_QUERY:
 		rm := &ReplyMessage{
@@ -148,7 +501,7 @@ func (s *Session) RespondToCommand(clientMessage Message, doc SimpleBSON) error
 			1, // NumberReturned
 			[]SimpleBSON{doc},
 		}
-		return SendMessage(rm, s.conn)
+		return s.sendPossiblyCompressed(rm, wasCompressed)
 
 	case OP_INSERT, OP_UPDATE, OP_DELETE:
 		// For MongoDB 2.6+, and wpv 3+, these are only used for unacknowledged writes, so do nothing
@@ -165,7 +518,7 @@ func (s *Session) RespondToCommand(clientMessage Message, doc SimpleBSON) error
 			SimpleBSONEmpty(),
 			[]SimpleBSON{},
 		}
-		return SendMessage(rm, s.conn)
+		return s.sendPossiblyCompressed(rm, wasCompressed)
 
 	case OP_MSG:
 		rm := &MessageMessage{
@@ -181,7 +534,7 @@ func (s *Session) RespondToCommand(clientMessage Message, doc SimpleBSON) error
 				},
 			},
 		}
-		return SendMessage(rm, s.conn)
+		return s.sendPossiblyCompressed(rm, wasCompressed)
 
 	default:
 		return ErrUnknownOpcode
@@ -206,7 +559,13 @@ func (s *Session) RespondWithError(clientMessage Message, err error) error {
 		return myErr
 	}
 
-	switch clientMessage.Header().OpCode {
+	opCode := clientMessage.Header().OpCode
+	wasCompressed := opCode == OP_COMPRESSED
+	if wasCompressed {
+		opCode = s.lastRequestOriginalOpcode
+	}
+
+	switch opCode {
 	case OP_QUERY, OP_GET_MORE:
 		rm := &ReplyMessage{
 			MessageHeader{
@@ -224,7 +583,7 @@ func (s *Session) RespondWithError(clientMessage Message, err error) error {
 			1, // NumberReturned
 			[]SimpleBSON{doc},
 		}
-		return SendMessage(rm, s.conn)
+		return s.sendPossiblyCompressed(rm, wasCompressed)
 
 	case OP_INSERT, OP_UPDATE, OP_DELETE:
 		// For MongoDB 2.6+, and wpv 3+, these are only used for unacknowledged writes, so do nothing
@@ -241,7 +600,7 @@ func (s *Session) RespondWithError(clientMessage Message, err error) error {
 			SimpleBSONEmpty(),
 			[]SimpleBSON{},
 		}
-		return SendMessage(rm, s.conn)
+		return s.sendPossiblyCompressed(rm, wasCompressed)
 
 	case OP_MSG:
 		rm := &MessageMessage{
@@ -257,7 +616,7 @@ func (s *Session) RespondWithError(clientMessage Message, err error) error {
 				},
 			},
 		}
-		return SendMessage(rm, s.conn)
+		return s.sendPossiblyCompressed(rm, wasCompressed)
 
 	default:
 		return ErrUnknownOpcode
@@ -273,33 +632,80 @@ func (s *Server) Run() error {
 
 	var tlsConfig *tls.Config
 
+	if s.config.MaxConcurrentConnections > 0 {
+		s.connSem = make(chan struct{}, s.config.MaxConcurrentConnections)
+	}
+
 	defer close(s.initChan)
 
 	if s.config.UseSSL {
-		if len(s.config.SSLKeys) == 0 {
-			returnErr := fmt.Errorf("no ssl keys configured")
+		if s.config.AutoCert && len(s.config.SSLKeys) > 0 {
+			returnErr := fmt.Errorf("AutoCert and SSLKeys are mutually exclusive")
 			s.initChan <- returnErr
 			return returnErr
 		}
 
-		certs := []tls.Certificate{}
-		for _, pair := range s.config.SSLKeys {
-			cer, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		var certs []tls.Certificate
+		if s.config.AutoCert {
+			cert, err := s.generateAutoCert()
 			if err != nil {
-				returnErr := fmt.Errorf("cannot LoadX509KeyPair from %s %s %s", pair.CertFile, pair.KeyFile, err)
+				returnErr := fmt.Errorf("cannot generate auto cert: %s", err)
+				s.initChan <- returnErr
+				return returnErr
+			}
+			certs = []tls.Certificate{cert}
+		} else {
+			if len(s.config.SSLKeys) == 0 {
+				returnErr := fmt.Errorf("no ssl keys configured")
+				s.initChan <- returnErr
+				return returnErr
+			}
+
+			var err error
+			certs, err = loadCertificates(s.config.SSLKeys)
+			if err != nil {
+				returnErr := fmt.Errorf("cannot load ssl keys: %s", err)
 				s.initChan <- returnErr
 				return returnErr
 			}
-			certs = append(certs, cer)
 		}
+		s.certStore.Store(certs)
 
-		tlsConfig = &tls.Config{Certificates: certs}
+		tlsConfig = &tls.Config{}
 
 		if s.config.MinTlsVersion != 0 {
 			tlsConfig.MinVersion = s.config.MinTlsVersion
 		}
 
-		tlsConfig.BuildNameToCertificate()
+		tlsConfig.ClientAuth = s.config.ClientAuth
+		tlsConfig.VerifyPeerCertificate = s.config.VerifyPeerCertificate
+
+		clientCAs := s.config.ClientCAs
+		if clientCAs == nil && s.config.ClientCAFile != "" {
+			pemBytes, err := ioutil.ReadFile(s.config.ClientCAFile)
+			if err != nil {
+				returnErr := fmt.Errorf("cannot read ClientCAFile %s: %s", s.config.ClientCAFile, err)
+				s.initChan <- returnErr
+				return returnErr
+			}
+			clientCAs = x509.NewCertPool()
+			if !clientCAs.AppendCertsFromPEM(pemBytes) {
+				returnErr := fmt.Errorf("no certificates found in ClientCAFile %s", s.config.ClientCAFile)
+				s.initChan <- returnErr
+				return returnErr
+			}
+		}
+		if clientCAs != nil {
+			tlsConfig.ClientCAs = clientCAs
+		}
+
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := tlsConfig.Clone()
+			cfg.GetConfigForClient = nil
+			cfg.Certificates = s.certStore.Load()
+			cfg.BuildNameToCertificate()
+			return cfg, nil
+		}
 	}
 
 	ln, err := net.Listen("tcp", bindTo)
@@ -311,6 +717,18 @@ func (s *Server) Run() error {
 	s.Addr = ln.Addr()
 	s.initChan <- nil
 
+	if s.config.NotifyReady {
+		if sent, err := daemon.SdNotify(false, daemon.SdNotifyReady); err != nil {
+			s.logger.Logf(slogger.WARN, "error sending systemd readiness notification: %s", err)
+		} else if !sent {
+			s.logger.Logf(slogger.INFO, "systemd notification socket not set, skipping readiness notification")
+		}
+	}
+
+	if s.config.UseSSL && s.config.WatchCertFiles && !s.config.AutoCert {
+		go s.watchCertFiles()
+	}
+
 	defer close(s.doneChan)
 	defer ln.Close()
 
@@ -329,7 +747,6 @@ func (s *Server) Run() error {
 
 		select {
 		case <-s.killChan:
-			// TODO close down all active connections before returning
 			return nil
 		case connectionEvent := <-incomingConnections:
 			if connectionEvent.err != nil {
@@ -346,27 +763,322 @@ func (s *Server) Run() error {
 				}
 			}
 
+			remoteAddr := conn.RemoteAddr()
+			ip := remoteIP(remoteAddr)
+
+			if s.config.MaxConnectionsPerRemoteIP > 0 {
+				s.perIPMu.Lock()
+				if s.perIP[ip] >= s.config.MaxConnectionsPerRemoteIP {
+					s.perIPMu.Unlock()
+					atomic.AddInt64(&s.rejectedCount, 1)
+					s.logger.Logf(slogger.WARN, "rejecting connection from %s: per-IP connection limit reached", remoteAddr)
+					conn.Close()
+					continue
+				}
+				s.perIP[ip]++
+				s.perIPMu.Unlock()
+			}
+
+			if s.connSem != nil {
+				if s.config.OnLimit == LimitPolicyBlock {
+					select {
+					case s.connSem <- struct{}{}:
+					case <-s.killChan:
+						conn.Close()
+						s.releasePerIP(ip)
+						return nil
+					}
+				} else {
+					select {
+					case s.connSem <- struct{}{}:
+					default:
+						atomic.AddInt64(&s.rejectedCount, 1)
+						s.logger.Logf(slogger.WARN, "rejecting connection from %s: max concurrent connections reached", remoteAddr)
+						conn.Close()
+						s.releasePerIP(ip)
+						continue
+					}
+				}
+			}
+
 			if s.config.UseSSL {
 				conn = tls.Server(conn, tlsConfig)
 			}
 
-			remoteAddr := conn.RemoteAddr()
-			c := &Session{s, nil, remoteAddr, s.NewLogger(fmt.Sprintf("Session %s", remoteAddr)), ""}
-			go c.Run(conn)
+			atomic.AddInt64(&s.acceptedCount, 1)
+			atomic.AddInt64(&s.activeCount, 1)
+
+			c := &Session{
+				server:     s,
+				remoteAddr: remoteAddr,
+				logger:     s.NewLogger(fmt.Sprintf("Session %s", remoteAddr)),
+			}
+			go func() {
+				defer atomic.AddInt64(&s.activeCount, -1)
+				defer s.releasePerIP(ip)
+				if s.connSem != nil {
+					defer func() { <-s.connSem }()
+				}
+				c.Run(conn)
+			}()
 		}
 
 	}
 }
 
+func (s *Server) releasePerIP(ip string) {
+	if s.config.MaxConnectionsPerRemoteIP <= 0 {
+		return
+	}
+	s.perIPMu.Lock()
+	defer s.perIPMu.Unlock()
+	if s.perIP[ip] <= 1 {
+		delete(s.perIP, ip)
+	} else {
+		s.perIP[ip]--
+	}
+}
+
+// remoteIP extracts the bare IP (no port) from a net.Addr for use as a
+// per-source throttling key.
+func remoteIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Stats returns a snapshot of the server's current connection counters.
+func (s *Server) Stats() ServerStats {
+	s.perIPMu.Lock()
+	perIP := make(map[string]int, len(s.perIP))
+	for ip, count := range s.perIP {
+		perIP[ip] = count
+	}
+	s.perIPMu.Unlock()
+
+	return ServerStats{
+		Active:   atomic.LoadInt64(&s.activeCount),
+		Accepted: atomic.LoadInt64(&s.acceptedCount),
+		Rejected: atomic.LoadInt64(&s.rejectedCount),
+		PerIP:    perIP,
+	}
+}
+
 // InitChannel returns a channel that will send nil once the server has started
 // listening, or an error indicating why the server failed to start
 func (s *Server) InitChannel() <-chan error {
 	return s.initChan
 }
 
+// Shutdown stops the server from accepting new connections and waits for
+// in-flight sessions to finish, mirroring net/http's Server.Shutdown. If ctx
+// is cancelled or its deadline fires before all sessions finish on their
+// own, Shutdown force-closes their connections and returns ctx.Err().
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.config.NotifyReady {
+		daemon.SdNotify(false, daemon.SdNotifyStopping)
+	}
+
+	s.killChanOnce.Do(func() { close(s.killChan) })
+
+	select {
+	case <-s.doneChan:
+	case <-ctx.Done():
+		s.forceCloseSessions()
+		return ctx.Err()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		for {
+			active := false
+			s.sessions.Range(func(key, _ interface{}) bool {
+				active = true
+				return false
+			})
+			if !active {
+				close(drained)
+				return
+			}
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		s.forceCloseSessions()
+		return ctx.Err()
+	}
+}
+
+// forceCloseSessions closes the conn of every session still tracked as
+// active, used by Shutdown once ctx expires so a hard deadline actually
+// terminates in-flight sessions instead of waiting on them forever.
+func (s *Server) forceCloseSessions() {
+	s.sessions.Range(func(key, _ interface{}) bool {
+		if session, ok := key.(*Session); ok {
+			session.conn.Close()
+		}
+		return true
+	})
+}
+
 func (s *Server) Close() {
-	close(s.killChan)
-	<-s.doneChan
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	s.Shutdown(ctx)
+}
+
+func loadCertificates(pairs []SSLPair) ([]tls.Certificate, error) {
+	certs := []tls.Certificate{}
+	for _, pair := range pairs {
+		cer, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot LoadX509KeyPair from %s %s: %s", pair.CertFile, pair.KeyFile, err)
+		}
+		certs = append(certs, cer)
+	}
+	return certs, nil
+}
+
+// generateAutoCert synthesizes a self-signed ECDSA P-256 certificate for
+// ServerConfig.AutoCert, valid for AutoCertTTL (default 24h) and covering
+// AutoCertHosts (default BindHost and localhost) plus the loopback IPs.
+func (s *Server) generateAutoCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot generate ECDSA key: %s", err)
+	}
+
+	serial, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot generate serial number: %s", err)
+	}
+
+	ttl := s.config.AutoCertTTL
+	if ttl == 0 {
+		ttl = 24 * time.Hour
+	}
+
+	hosts := s.config.AutoCertHosts
+	if len(hosts) == 0 {
+		hosts = []string{"localhost"}
+		if s.config.BindHost != "" {
+			hosts = append(hosts, s.config.BindHost)
+		}
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "mongonet-autocert"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(ttl),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              hosts,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot create self-signed certificate: %s", err)
+	}
+
+	fingerprint := sha256.Sum256(der)
+	s.logger.Logf(slogger.WARN, "using auto-generated TLS certificate, SHA-256 fingerprint %x", fingerprint)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// ReloadTLS re-reads every SSLPair from disk and, if all of them parse
+// successfully, atomically swaps them in for future handshakes. On any
+// parse error it leaves the currently-served certificates untouched.
+func (s *Server) ReloadTLS() error {
+	if s.config.AutoCert {
+		return fmt.Errorf("ReloadTLS is not supported when AutoCert is enabled")
+	}
+
+	certs, err := loadCertificates(s.config.SSLKeys)
+	if err != nil {
+		return fmt.Errorf("not reloading TLS certificates: %s", err)
+	}
+	s.certStore.Store(certs)
+	s.logger.Logf(slogger.INFO, "reloaded %d TLS certificate(s)", len(certs))
+	return nil
+}
+
+// watchCertFiles polls the mtime of every configured cert/key file and calls
+// ReloadTLS whenever one changes. It runs until the server is shut down.
+func (s *Server) watchCertFiles() {
+	statMTime := func(path string) time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+
+	mtimes := map[string]time.Time{}
+	for _, pair := range s.config.SSLKeys {
+		mtimes[pair.CertFile] = statMTime(pair.CertFile)
+		mtimes[pair.KeyFile] = statMTime(pair.KeyFile)
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.killChan:
+			return
+		case <-ticker.C:
+			changed := false
+			for path, prev := range mtimes {
+				if cur := statMTime(path); !cur.Equal(prev) {
+					mtimes[path] = cur
+					changed = true
+				}
+			}
+			if !changed {
+				continue
+			}
+			if err := s.ReloadTLS(); err != nil {
+				s.logger.Logf(slogger.WARN, "error reloading TLS certificates: %s", err)
+			}
+		}
+	}
+}
+
+// HandleSIGHUPForTLSReload installs a SIGHUP handler that calls ReloadTLS,
+// as is conventional for long-running proxies whose certs are rotated by
+// something like Vault or cert-manager. Callers that want to stop handling
+// SIGHUP this way can pass the returned channel to signal.Stop.
+func (s *Server) HandleSIGHUPForTLSReload() chan<- os.Signal {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	go func() {
+		for range sigChan {
+			if err := s.ReloadTLS(); err != nil {
+				s.logger.Logf(slogger.WARN, "error reloading TLS certificates on SIGHUP: %s", err)
+			}
+		}
+	}()
+	return sigChan
 }
 
 func (s *Server) NewLogger(prefix string) *slogger.Logger {
@@ -382,12 +1094,13 @@ func (s *Server) NewLogger(prefix string) *slogger.Logger {
 
 func NewServer(config ServerConfig, factory ServerWorkerFactory) Server {
 	return Server{
-		config,
-		&slogger.Logger{"Server", config.Appenders, 0, nil},
-		factory,
-		make(chan struct{}),
-		make(chan error, 1),
-		make(chan struct{}),
-		nil,
+		config:        config,
+		logger:        &slogger.Logger{"Server", config.Appenders, 0, nil},
+		workerFactory: factory,
+		killChan:      make(chan struct{}),
+		initChan:      make(chan error, 1),
+		doneChan:      make(chan struct{}),
+		certStore:     &certStore{},
+		perIP:         map[string]int{},
 	}
 }